@@ -3,9 +3,12 @@ package stagedsync
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"math/big"
+	"sync"
 	"time"
 
 	mapset "github.com/deckarep/golang-set"
@@ -16,6 +19,7 @@ import (
 	"github.com/ledgerwatch/erigon/consensus"
 	"github.com/ledgerwatch/erigon/core"
 	"github.com/ledgerwatch/erigon/core/rawdb"
+	"github.com/ledgerwatch/erigon/core/state"
 	"github.com/ledgerwatch/erigon/core/types"
 	"github.com/ledgerwatch/erigon/eth/ethutils"
 	"github.com/ledgerwatch/erigon/params"
@@ -32,20 +36,311 @@ type MiningBlock struct {
 	RemoteTxs types.TransactionsStream
 }
 
+// PayloadID identifies a block assembled on behalf of an external consensus
+// layer via PayloadAttributes, so it can later be retrieved by an
+// engine_getPayloadV1-style RPC call.
+type PayloadID [8]byte
+
+// PayloadAttributes is the subset of the Engine API ForkchoiceStateV1 /
+// PayloadAttributesV1 fields needed to assemble a block on top of a
+// caller-specified parent, rather than the locally canonical head.
+type PayloadAttributes struct {
+	ParentHash            common.Hash
+	Timestamp             uint64
+	PrevRandao            common.Hash
+	SuggestedFeeRecipient common.Address
+
+	// Transactions, if non-empty, are forced-inclusion transactions that
+	// must be placed ahead of anything pulled from the mempool.
+	Transactions []types.Transaction
+}
+
+// computePayloadID derives a PayloadID from a PayloadAttributes by hashing
+// its ParentHash, Timestamp, PrevRandao and SuggestedFeeRecipient, so repeated
+// calls with identical attributes yield the same id. Transactions are not
+// hashed, so attributes differing only in Transactions share an id.
+func computePayloadID(attrs *PayloadAttributes) (id PayloadID) {
+	hasher := sha256.New()
+	hasher.Write(attrs.ParentHash.Bytes())
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], attrs.Timestamp)
+	hasher.Write(timestamp[:])
+	hasher.Write(attrs.PrevRandao.Bytes())
+	hasher.Write(attrs.SuggestedFeeRecipient.Bytes())
+	copy(id[:], hasher.Sum(nil))
+	return id
+}
+
+// PayloadResult is published through MiningState.PublishPayloadResult once a
+// block requested via PayloadAttributes has been assembled.
+type PayloadResult struct {
+	ID    PayloadID
+	Block *MiningBlock
+}
+
+// payloadStore guards pending PayloadResults keyed by PayloadID, so an
+// engine_getPayloadV1-style poller can retrieve one without the producer
+// risking a block if nobody's listening yet. It is referenced through a
+// pointer so it survives MiningState being copied.
+type payloadStore struct {
+	mu      sync.Mutex
+	results map[PayloadID]*PayloadResult
+}
+
+const (
+	// minRecommitInterval and maxRecommitInterval bound how often the mining
+	// loop is willing to re-assemble a block, in response to ResubmitAdjustCh.
+	minRecommitInterval = 1 * time.Second
+	maxRecommitInterval = 15 * time.Second
+	// targetGasRatio is the gasUsed/gasLimit fraction block sealing aims for.
+	targetGasRatio = 0.5
+	// resubmitDampingFactor caps how much a single block's gas usage can
+	// move the suggested interval: a Ratio of e.g. 2x is damped down so it
+	// only nudges the interval by resubmitDampingFactor (10%).
+	resubmitDampingFactor = 0.1
+)
+
+// ResubmitAdjust is pushed onto MiningState.ResubmitAdjustCh after a block
+// is sealed, asking the resubmit interval to shrink (Inc == false) or grow
+// (Inc == true) by roughly Ratio.
+type ResubmitAdjust struct {
+	Inc   bool
+	Ratio float64
+}
+
+// resubmitState holds the EWMA of gasUsed/gasLimit across sealed blocks and
+// the resubmit interval it drives, guarded by mu since recordGasUsed and the
+// consuming goroutine started by newResubmitState run concurrently. It is
+// referenced through a pointer so it survives MiningState being copied.
+type resubmitState struct {
+	mu           sync.Mutex
+	gasRatioEWMA float64
+	interval     time.Duration
+}
+
+// newResubmitState starts the goroutine that applies ResubmitAdjust events
+// from adjustCh to the interval, clamped to [minRecommitInterval,
+// maxRecommitInterval]. It is the sole mutator of the interval.
+//
+// Nothing in this tree yet reads the resulting interval back out to actually
+// re-trigger block assembly on a schedule; see the TODO on
+// MiningState.ResubmitInterval.
+func newResubmitState(initial time.Duration, adjustCh <-chan ResubmitAdjust) *resubmitState {
+	r := &resubmitState{interval: initial}
+	go r.consume(adjustCh)
+	return r
+}
+
+func (r *resubmitState) consume(adjustCh <-chan ResubmitAdjust) {
+	for adjust := range adjustCh {
+		r.mu.Lock()
+		next := r.interval
+		if adjust.Inc {
+			next = time.Duration(float64(next) * adjust.Ratio)
+		} else {
+			next = time.Duration(float64(next) / adjust.Ratio)
+		}
+		switch {
+		case next < minRecommitInterval:
+			next = minRecommitInterval
+		case next > maxRecommitInterval:
+			next = maxRecommitInterval
+		}
+		r.interval = next
+		r.mu.Unlock()
+	}
+}
+
+func (r *resubmitState) Interval() time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.interval
+}
+
+// pendingStaleThreshold is the maximum number of blocks the pending snapshot
+// may lag the chain's ExecutionAt before Pending()/PendingBlock() give up
+// and return nil rather than a partially-initialized block.
+const pendingStaleThreshold = 1
+
+// pendingSnapshot is the most recent locally-assembled block consumable by
+// RPC as "pending" (eth_getBlockByNumber("pending"), eth_call, etc.).
+type pendingSnapshot struct {
+	block              *types.Block
+	ibs                *state.IntraBlockState
+	builtAtExecutionAt uint64
+}
+
+// pendingStore guards the latest pendingSnapshot. It does not track the chain
+// head: Pending takes the current executionAt from its caller to judge
+// staleness. It is referenced through a pointer so it survives MiningState
+// being copied.
+type pendingStore struct {
+	mu       sync.Mutex
+	snapshot *pendingSnapshot
+}
+
 type MiningState struct {
 	MiningConfig    *params.MiningConfig
 	PendingResultCh chan *types.Block
 	MiningResultCh  chan *types.Block
 	MiningBlock     *MiningBlock
+
+	// ResubmitAdjustCh carries interval-adjustment requests driven by how
+	// full previously sealed blocks were; recordGasUsed is the producer and
+	// resubmitState.consume is the sole consumer and mutator of the interval.
+	ResubmitAdjustCh chan ResubmitAdjust
+
+	resubmit *resubmitState
+	pending  *pendingStore
+	payloads *payloadStore
 }
 
 func NewMiningState(cfg *params.MiningConfig) MiningState {
+	adjustCh := make(chan ResubmitAdjust, 8)
 	return MiningState{
-		MiningConfig:    cfg,
-		PendingResultCh: make(chan *types.Block, 1),
-		MiningResultCh:  make(chan *types.Block, 1),
-		MiningBlock:     &MiningBlock{},
+		MiningConfig:     cfg,
+		PendingResultCh:  make(chan *types.Block, 1),
+		MiningResultCh:   make(chan *types.Block, 1),
+		MiningBlock:      &MiningBlock{},
+		ResubmitAdjustCh: adjustCh,
+		resubmit:         newResubmitState(3*time.Second, adjustCh),
+		pending:          &pendingStore{},
+		payloads:         &payloadStore{results: map[PayloadID]*PayloadResult{}},
+	}
+}
+
+// PublishPayloadResult stores a just-assembled payload result, overwriting
+// any previous result for the same PayloadID. Unlike a send on a bounded
+// channel, this never blocks the stage goroutine waiting on a reader.
+func (m *MiningState) PublishPayloadResult(result *PayloadResult) {
+	m.payloads.mu.Lock()
+	defer m.payloads.mu.Unlock()
+	m.payloads.results[result.ID] = result
+}
+
+// PayloadResultByID returns the most recently assembled block for id, for an
+// engine_getPayloadV1-style handler. ok is false if id hasn't been assembled
+// yet. The consensus layer computes a fresh PayloadID on essentially every
+// forkchoiceUpdated call, so a retrieved result is deleted on read rather
+// than kept around forever: engine_getPayloadV1 is poll-once-then-discard,
+// and without this results would grow unbounded for the life of the process.
+func (m *MiningState) PayloadResultByID(id PayloadID) (result *PayloadResult, ok bool) {
+	m.payloads.mu.Lock()
+	defer m.payloads.mu.Unlock()
+	result, ok = m.payloads.results[id]
+	if ok {
+		delete(m.payloads.results, id)
+	}
+	return result, ok
+}
+
+// ResubmitInterval returns the interval recordGasUsed currently recommends
+// between block re-assembly attempts, continuously adjusted from the EWMA of
+// gasUsed/gasLimit across sealed blocks.
+// TODO: no driver loop exists yet in this tree to read this value and
+// re-invoke SpawnMiningCreateBlockStage on a schedule; wire one in once a
+// scheduled-resubmit caller lands, so this stops being bookkeeping nobody
+// consumes.
+func (m *MiningState) ResubmitInterval() time.Duration {
+	return m.resubmit.Interval()
+}
+
+// Pending returns the most recently assembled "pending" block together with
+// the IntraBlockState it was executed against. It returns (nil, nil) if
+// mining is disabled or the snapshot has fallen more than
+// pendingStaleThreshold blocks behind executionAt, so RPC can respond with a
+// clear "pending block is not available" error instead of handing out a
+// partially-initialized block.
+//
+// executionAt is the caller's current chain head: MiningState holds no DB
+// handle of its own, so staleness can't be judged without it. Callers (the
+// RPC layer) already have this from the same db.Tx they'd otherwise pass in.
+func (m *MiningState) Pending(executionAt uint64) (*types.Block, *state.IntraBlockState) {
+	m.pending.mu.Lock()
+	defer m.pending.mu.Unlock()
+	snap := m.pending.snapshot
+	if snap == nil {
+		return nil, nil
+	}
+	if executionAt > snap.builtAtExecutionAt+pendingStaleThreshold {
+		return nil, nil
+	}
+	return snap.block, snap.ibs
+}
+
+// PendingBlock returns just the header/body half of Pending(), for callers
+// that don't need post-execution state (e.g. eth_getBlockByNumber("pending")).
+func (m *MiningState) PendingBlock(executionAt uint64) *types.Block {
+	block, _ := m.Pending(executionAt)
+	return block
+}
+
+// setPendingHeader publishes a header-only pending snapshot, taken right
+// after block assembly and before the exec stage has produced receipts/state.
+func (m *MiningState) setPendingHeader(header *types.Header, executionAt uint64) {
+	m.pending.mu.Lock()
+	defer m.pending.mu.Unlock()
+	m.pending.snapshot = &pendingSnapshot{
+		block:              types.NewBlockWithHeader(header),
+		builtAtExecutionAt: executionAt,
+	}
+}
+
+// UpdatePendingResult replaces the pending snapshot with the fully-executed
+// block and the state it produced, once the exec stage has run.
+// TODO: no exec stage exists yet in this tree to call this; wire it in once
+// one lands, so Pending()/PendingBlock() can return receipts/state instead
+// of a header-only snapshot.
+func (m *MiningState) UpdatePendingResult(block *types.Block, ibs *state.IntraBlockState, executionAt uint64) {
+	m.pending.mu.Lock()
+	defer m.pending.mu.Unlock()
+	m.pending.snapshot = &pendingSnapshot{
+		block:              block,
+		ibs:                ibs,
+		builtAtExecutionAt: executionAt,
+	}
+}
+
+// recordGasUsed folds the gasUsed/gasLimit ratio of a just-sealed block into
+// an EWMA and pushes a damped ResubmitAdjust onto ResubmitAdjustCh.
+func (m *MiningState) recordGasUsed(gasUsed, gasLimit uint64) {
+	if gasLimit == 0 {
+		return
+	}
+	m.resubmit.mu.Lock()
+	ratio := float64(gasUsed) / float64(gasLimit)
+	if m.resubmit.gasRatioEWMA == 0 {
+		m.resubmit.gasRatioEWMA = ratio
+	} else {
+		m.resubmit.gasRatioEWMA = 0.9*m.resubmit.gasRatioEWMA + 0.1*ratio
+	}
+	observed := m.resubmit.gasRatioEWMA
+	m.resubmit.mu.Unlock()
+	if observed <= 0 {
+		return
+	}
+
+	var rawRatio float64
+	inc := observed >= targetGasRatio
+	if inc {
+		rawRatio = observed / targetGasRatio
+	} else {
+		rawRatio = targetGasRatio / observed
+	}
+	// Damp so a single sample can't swing the interval by more than ~10%:
+	// clamp the damped ratio itself, since rawRatio is otherwise unbounded
+	// (an EWMA seeded from one near-empty or near-full block can be 50x off
+	// target) and "1 + factor*(rawRatio-1)" alone only stays near 1+factor
+	// for rawRatio close to 2.
+	dampedRatio := 1 + resubmitDampingFactor*(rawRatio-1)
+	switch {
+	case dampedRatio < 1-resubmitDampingFactor:
+		dampedRatio = 1 - resubmitDampingFactor
+	case dampedRatio > 1+resubmitDampingFactor:
+		dampedRatio = 1 + resubmitDampingFactor
 	}
+
+	m.ResubmitAdjustCh <- ResubmitAdjust{Inc: inc, Ratio: dampedRatio}
 }
 
 type MiningCreateBlockCfg struct {
@@ -57,6 +352,18 @@ type MiningCreateBlockCfg struct {
 	txPool2     *txpool.TxPool
 	txPool2DB   kv.RoDB
 	tmpdir      string
+
+	// payloadAttributes, when set, switches SpawnMiningCreateBlockStage
+	// into Engine API mode: the block is built on top of the given parent
+	// hash with the given timestamp/prevRandao/feeRecipient instead of the
+	// locally canonical head and MiningConfig.Etherbase.
+	payloadAttributes *PayloadAttributes
+
+	// txOrderer selects and orders the transactions fed to block assembly.
+	// Defaults to the price-and-nonce/fixed-order behaviour below, but can
+	// be swapped out (see WithTxOrderer) for e.g. a bundle-merging builder
+	// integration.
+	txOrderer TxOrderer
 }
 
 func StageMiningCreateBlockCfg(
@@ -78,97 +385,103 @@ func StageMiningCreateBlockCfg(
 		txPool2:     txPool2,
 		txPool2DB:   txPool2DB,
 		tmpdir:      tmpdir,
+		txOrderer:   NewDefaultTxOrderer(txPool, txPool2, txPool2DB),
+	}
+}
+
+// WithTxOrderer returns a copy of cfg that orders block-assembly
+// transactions through orderer instead of the default price-and-nonce
+// behaviour, for builder/searcher integrations such as BundleOrderer.
+func (cfg MiningCreateBlockCfg) WithTxOrderer(orderer TxOrderer) MiningCreateBlockCfg {
+	cfg.txOrderer = orderer
+	return cfg
+}
+
+// WithPayloadAttributes returns a copy of cfg that builds the next block from
+// the given PayloadAttributes instead of from local chain state, for use by
+// an Engine API (engine_forkchoiceUpdatedV1/engine_getPayloadV1) handler.
+func (cfg MiningCreateBlockCfg) WithPayloadAttributes(attrs *PayloadAttributes) MiningCreateBlockCfg {
+	cfg.payloadAttributes = attrs
+	return cfg
+}
+
+// isPostMerge reports whether the block being assembled should be treated as
+// post-merge: either it's being built from PayloadAttributes supplied by an
+// external consensus layer (which only exist post-merge), or the parent's
+// total difficulty has reached ttd. A nil ttd or parentTd means the chain
+// isn't TTD-aware yet, or the parent's total difficulty couldn't be read, so
+// both are treated as pre-merge.
+func isPostMerge(attrs *PayloadAttributes, ttd, parentTd *big.Int) bool {
+	if attrs != nil {
+		return true
 	}
+	return ttd != nil && parentTd != nil && parentTd.Cmp(ttd) >= 0
 }
 
 // SpawnMiningCreateBlockStage
-//TODO:
-// - resubmitAdjustCh - variable is not implemented
 func SpawnMiningCreateBlockStage(s *StageState, tx kv.RwTx, cfg MiningCreateBlockCfg, quit <-chan struct{}) (err error) {
 	current := cfg.miner.MiningBlock
 	txPoolLocals := cfg.txPool.Locals()
 	coinbase := cfg.miner.MiningConfig.Etherbase
+	payloadAttributes := cfg.payloadAttributes
 
 	const (
 		// staleThreshold is the maximum depth of the acceptable stale block.
 		staleThreshold = 7
 	)
 
-	if cfg.miner.MiningConfig.Etherbase == (common.Address{}) {
-		return fmt.Errorf("refusing to mine without etherbase")
+	// Feed the gas usage of the block we just finished sealing (if any) into
+	// the resubmit-interval EWMA before starting a new one.
+	if current.Header != nil {
+		cfg.miner.recordGasUsed(current.Header.GasUsed, current.Header.GasLimit)
 	}
 
 	logPrefix := s.LogPrefix()
-	executionAt, err := s.ExecutionAt(tx)
-	if err != nil {
-		return fmt.Errorf("getting last executed block: %w", err)
-	}
-	parent := rawdb.ReadHeaderByNumber(tx, executionAt)
-	if parent == nil { // todo: how to return error and don't stop Erigon?
-		return fmt.Errorf(fmt.Sprintf("[%s] Empty block", logPrefix), "blocknum", executionAt)
-	}
-	log.Info(fmt.Sprintf("[%s] Start mine", logPrefix), "block", executionAt+1)
 
-	blockNum := executionAt + 1
-	if cfg.txPool2 != nil {
-		txSlots := txpool.TxsRlp{}
-		if err = cfg.txPool2DB.View(context.Background(), func(tx kv.Tx) error {
-			if err := cfg.txPool2.Best(200, &txSlots, tx); err != nil {
-				return err
-			}
-			for i := 0; i < len(txSlots.Txs); i++ {
-				txSlots.Txs[i] = common.CopyBytes(txSlots.Txs[i]) // because we need this data outside of tx
-			}
-			return nil
-		}); err != nil {
-			return err
-		}
-		txs, err := types.UnmarshalTransactionsFromBinary(txSlots.Txs)
-		if err != nil {
-			return fmt.Errorf("decode rlp of pending txs: %w", err)
-		}
-		var sender common.Address
-		for i := range txs {
-			copy(sender[:], txSlots.Senders.At(i))
-			txs[i].SetSender(sender)
+	var parent *types.Header
+	var blockNum uint64
+	var executionAt uint64
+	if payloadAttributes != nil {
+		// Engine API mode: build on top of the caller-specified parent
+		// rather than the locally canonical head.
+		parent = rawdb.ReadHeaderByHash(tx, payloadAttributes.ParentHash)
+		if parent == nil {
+			return fmt.Errorf("unknown parent %x for payload attributes", payloadAttributes.ParentHash)
 		}
-		current.RemoteTxs = types.NewTransactionsFixedOrder(txs)
-		// txpool v2 - doesn't prioritise local txs over remote
-		current.LocalTxs = types.NewTransactionsFixedOrder(nil)
+		blockNum = parent.Number.Uint64() + 1
+		log.Info(fmt.Sprintf("[%s] Start assembling payload", logPrefix), "block", blockNum)
 	} else {
-		pendingTxs, err := cfg.txPool.Pending()
+		if cfg.miner.MiningConfig.Etherbase == (common.Address{}) {
+			return fmt.Errorf("refusing to mine without etherbase")
+		}
+		var err error
+		executionAt, err = s.ExecutionAt(tx)
 		if err != nil {
-			return err
+			return fmt.Errorf("getting last executed block: %w", err)
 		}
-		// Split the pending transactions into locals and remotes
-		localTxs, remoteTxs := types.TransactionsGroupedBySender{}, types.TransactionsGroupedBySender{}
-		signer := types.MakeSigner(&cfg.chainConfig, blockNum)
-		for _, txs := range pendingTxs {
-			if len(txs) == 0 {
-				continue
-			}
-			from, _ := txs[0].Sender(*signer)
-			isLocal := false
-			for _, local := range txPoolLocals {
-				if local == from {
-					isLocal = true
-					break
-				}
-			}
-
-			if isLocal {
-				localTxs = append(localTxs, txs)
-			} else {
-				remoteTxs = append(remoteTxs, txs)
-			}
+		parent = rawdb.ReadHeaderByNumber(tx, executionAt)
+		if parent == nil { // todo: how to return error and don't stop Erigon?
+			return fmt.Errorf(fmt.Sprintf("[%s] Empty block", logPrefix), "blocknum", executionAt)
 		}
+		log.Info(fmt.Sprintf("[%s] Start mine", logPrefix), "block", executionAt+1)
+		blockNum = executionAt + 1
+	}
 
-		current.LocalTxs = types.NewTransactionsByPriceAndNonce(*signer, localTxs)
-		current.RemoteTxs = types.NewTransactionsByPriceAndNonce(*signer, remoteTxs)
+	// Once the parent has crossed TerminalTotalDifficulty, treat this exactly
+	// like a PayloadAttributes-driven block: no uncles, no DAO-fork override,
+	// zero difficulty. Avoids a wasted ReadHeadersByNumber on every post-merge block.
+	var parentTd *big.Int
+	if payloadAttributes == nil && cfg.chainConfig.TerminalTotalDifficulty != nil {
+		parentTd = rawdb.ReadTd(tx, parent.Hash(), parent.Number.Uint64())
 	}
-	localUncles, remoteUncles, err := readNonCanonicalHeaders(tx, blockNum, cfg.engine, coinbase, txPoolLocals)
-	if err != nil {
-		return err
+	postMerge := isPostMerge(payloadAttributes, cfg.chainConfig.TerminalTotalDifficulty, parentTd)
+
+	var localUncles, remoteUncles map[common.Hash]*types.Header
+	if !postMerge {
+		localUncles, remoteUncles, err = readNonCanonicalHeaders(tx, blockNum, cfg.engine, coinbase, txPoolLocals)
+		if err != nil {
+			return err
+		}
 	}
 	chain := ChainReader{Cfg: cfg.chainConfig, Db: tx}
 	var GetBlocksFromHash = func(hash common.Hash, n int) (blocks []*types.Block) {
@@ -201,24 +514,30 @@ func SpawnMiningCreateBlockStage(s *StageState, tx kv.RwTx, cfg MiningCreateBloc
 		uncles:    mapset.NewSet(),
 	}
 
-	// re-written miner/worker.go:commitNewWork
-	timestamp := time.Now().Unix()
-	if parent.Time >= uint64(timestamp) {
-		timestamp = int64(parent.Time + 1)
-	}
 	num := parent.Number
 	header := &types.Header{
 		ParentHash: parent.Hash(),
 		Number:     num.Add(num, common.Big1),
 		GasLimit:   core.CalcGasLimit(parent.GasUsed, parent.GasLimit, cfg.miner.MiningConfig.GasFloor, cfg.miner.MiningConfig.GasCeil),
 		Extra:      cfg.miner.MiningConfig.ExtraData,
-		Time:       uint64(timestamp),
 	}
 
-	// Only set the coinbase if our consensus engine is running (avoid spurious block rewards)
-	//if w.isRunning() {
-	header.Coinbase = coinbase
-	//}
+	if payloadAttributes != nil {
+		header.Time = payloadAttributes.Timestamp
+		header.Coinbase = payloadAttributes.SuggestedFeeRecipient
+		header.MixDigest = payloadAttributes.PrevRandao
+	} else {
+		// re-written miner/worker.go:commitNewWork
+		timestamp := time.Now().Unix()
+		if parent.Time >= uint64(timestamp) {
+			timestamp = int64(parent.Time + 1)
+		}
+		header.Time = uint64(timestamp)
+		// Only set the coinbase if our consensus engine is running (avoid spurious block rewards)
+		//if w.isRunning() {
+		header.Coinbase = coinbase
+		//}
+	}
 
 	if err = cfg.engine.Prepare(chain, header); err != nil {
 		log.Error("Failed to prepare header for mining",
@@ -232,8 +551,14 @@ func SpawnMiningCreateBlockStage(s *StageState, tx kv.RwTx, cfg MiningCreateBloc
 		return err
 	}
 
-	// If we are care about TheDAO hard-fork check whether to override the extra-data or not
-	if daoBlock := cfg.chainConfig.DAOForkBlock; daoBlock != nil {
+	if postMerge {
+		header.Difficulty = common.Big0
+		header.UncleHash = types.EmptyUncleHash
+	}
+
+	// If we are care about TheDAO hard-fork check whether to override the extra-data or not.
+	// Post-merge blocks are long past any DAO-fork range.
+	if daoBlock := cfg.chainConfig.DAOForkBlock; daoBlock != nil && !postMerge {
 		// Check whether the block is among the fork extra-override range
 		limit := new(big.Int).Add(daoBlock, params.DAOForkExtraRange)
 		if header.Number.Cmp(daoBlock) >= 0 && header.Number.Cmp(limit) < 0 {
@@ -246,6 +571,16 @@ func SpawnMiningCreateBlockStage(s *StageState, tx kv.RwTx, cfg MiningCreateBloc
 		}
 	}
 
+	var forced []types.Transaction
+	if payloadAttributes != nil {
+		forced = payloadAttributes.Transactions
+	}
+	current.LocalTxs, err = cfg.txOrderer.Order(context.Background(), parent, header, forced, env.signer)
+	if err != nil {
+		return fmt.Errorf("ordering transactions: %w", err)
+	}
+	current.RemoteTxs = types.NewTransactionsFixedOrder(nil)
+
 	// analog of miner.Worker.updateSnapshot
 	var makeUncles = func(proposedUncles mapset.Set) []*types.Header {
 		var uncles []*types.Header
@@ -267,60 +602,74 @@ func SpawnMiningCreateBlockStage(s *StageState, tx kv.RwTx, cfg MiningCreateBloc
 		})
 		return uncles
 	}
-	// when 08 is processed ancestors contain 07 (quick block)
-	for _, ancestor := range GetBlocksFromHash(parent.Hash(), 7) {
-		for _, uncle := range ancestor.Uncles() {
-			env.family.Add(uncle.Hash())
-		}
-		env.family.Add(ancestor.Hash())
-		env.ancestors.Add(ancestor.Hash())
-	}
-	commitUncle := func(env *envT, uncle *types.Header) error {
-		hash := uncle.Hash()
-		if env.uncles.Contains(hash) {
-			return errors.New("uncle not unique")
-		}
-		if parent.Hash() == uncle.ParentHash {
-			return errors.New("uncle is sibling")
-		}
-		if !env.ancestors.Contains(uncle.ParentHash) {
-			return errors.New("uncle's parent unknown")
-		}
-		if env.family.Contains(hash) {
-			return errors.New("uncle already included")
+	// Post-merge blocks have no uncles.
+	if !postMerge {
+		// when 08 is processed ancestors contain 07 (quick block)
+		for _, ancestor := range GetBlocksFromHash(parent.Hash(), 7) {
+			for _, uncle := range ancestor.Uncles() {
+				env.family.Add(uncle.Hash())
+			}
+			env.family.Add(ancestor.Hash())
+			env.ancestors.Add(ancestor.Hash())
 		}
-		env.uncles.Add(uncle.Hash())
-		return nil
-	}
-
-	// Accumulate the miningUncles for the env block
-	// Prefer to locally generated uncle
-	uncles := make([]*types.Header, 0, 2)
-	for _, blocks := range []map[common.Hash]*types.Header{localUncles, remoteUncles} {
-		// Clean up stale uncle blocks first
-		for hash, uncle := range blocks {
-			if uncle.Number.Uint64()+staleThreshold <= header.Number.Uint64() {
-				delete(blocks, hash)
+		commitUncle := func(env *envT, uncle *types.Header) error {
+			hash := uncle.Hash()
+			if env.uncles.Contains(hash) {
+				return errors.New("uncle not unique")
+			}
+			if parent.Hash() == uncle.ParentHash {
+				return errors.New("uncle is sibling")
 			}
+			if !env.ancestors.Contains(uncle.ParentHash) {
+				return errors.New("uncle's parent unknown")
+			}
+			if env.family.Contains(hash) {
+				return errors.New("uncle already included")
+			}
+			env.uncles.Add(uncle.Hash())
+			return nil
 		}
-		for hash, uncle := range blocks {
-			if len(uncles) == 2 {
-				break
+
+		// Accumulate the miningUncles for the env block
+		// Prefer to locally generated uncle
+		uncles := make([]*types.Header, 0, 2)
+		for _, blocks := range []map[common.Hash]*types.Header{localUncles, remoteUncles} {
+			// Clean up stale uncle blocks first
+			for hash, uncle := range blocks {
+				if uncle.Number.Uint64()+staleThreshold <= header.Number.Uint64() {
+					delete(blocks, hash)
+				}
 			}
-			if err = commitUncle(env, uncle); err != nil {
-				log.Trace("Possible uncle rejected", "hash", hash, "reason", err)
-			} else {
-				log.Debug("Committing new uncle to block", "hash", hash)
-				uncles = append(uncles, uncle)
+			for hash, uncle := range blocks {
+				if len(uncles) == 2 {
+					break
+				}
+				if err = commitUncle(env, uncle); err != nil {
+					log.Trace("Possible uncle rejected", "hash", hash, "reason", err)
+				} else {
+					log.Debug("Committing new uncle to block", "hash", hash)
+					uncles = append(uncles, uncle)
+				}
 			}
 		}
 	}
 
 	current.Header = header
 	current.Uncles = makeUncles(env.uncles)
+
+	if payloadAttributes != nil {
+		cfg.miner.PublishPayloadResult(&PayloadResult{ID: computePayloadID(payloadAttributes), Block: current})
+	} else {
+		// Header-only pending snapshot; the exec stage fills in receipts and
+		// state once it has run against this header.
+		cfg.miner.setPendingHeader(header, executionAt)
+	}
 	return nil
 }
 
+// readNonCanonicalHeaders collects uncle candidates for blockNum. Callers
+// must skip it once the parent has crossed TerminalTotalDifficulty: uncles
+// don't exist post-merge, and this avoids the ReadHeadersByNumber scan.
 func readNonCanonicalHeaders(tx kv.Tx, blockNum uint64, engine consensus.Engine, coinbase common.Address, txPoolLocals []common.Address) (localUncles, remoteUncles map[common.Hash]*types.Header, err error) {
 	localUncles, remoteUncles = map[common.Hash]*types.Header{}, map[common.Hash]*types.Header{}
 	nonCanonicalBlocks, err := rawdb.ReadHeadersByNumber(tx, blockNum)
@@ -0,0 +1,294 @@
+package stagedsync
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core/state"
+	"github.com/ledgerwatch/erigon/core/types"
+)
+
+func TestRecordGasUsedGrowsIntervalWhenBlocksAreFull(t *testing.T) {
+	m := NewMiningState(nil)
+	before := m.ResubmitInterval()
+
+	for i := 0; i < 5; i++ {
+		m.recordGasUsed(950, 1000) // far above targetGasRatio
+	}
+	waitForResubmitAdjust(t, &m)
+
+	if got := m.ResubmitInterval(); got <= before {
+		t.Fatalf("ResubmitInterval did not grow: before=%s after=%s", before, got)
+	}
+}
+
+func TestRecordGasUsedShrinksIntervalWhenBlocksAreEmpty(t *testing.T) {
+	m := NewMiningState(nil)
+	before := m.ResubmitInterval()
+
+	for i := 0; i < 5; i++ {
+		m.recordGasUsed(10, 1000) // far below targetGasRatio
+	}
+	waitForResubmitAdjust(t, &m)
+
+	if got := m.ResubmitInterval(); got >= before {
+		t.Fatalf("ResubmitInterval did not shrink: before=%s after=%s", before, got)
+	}
+}
+
+func TestRecordGasUsedSingleExtremeSampleMovesIntervalByAtMostDampingFactor(t *testing.T) {
+	m := NewMiningState(nil)
+	before := m.ResubmitInterval()
+
+	// A single near-empty block: observed == EWMA seed == 0.01, so rawRatio
+	// (target/observed) is 50x off target. The damped, clamped adjustment
+	// must still only move the interval by ~resubmitDampingFactor (10%).
+	m.recordGasUsed(10, 1000)
+	waitForResubmitAdjust(t, &m)
+
+	after := m.ResubmitInterval()
+	if after >= before {
+		t.Fatalf("expected the interval to shrink: before=%s after=%s", before, after)
+	}
+	minAllowed := time.Duration(float64(before) * (1 - resubmitDampingFactor - 0.01))
+	if after < minAllowed {
+		t.Fatalf("single sample swung the interval by more than ~%.0f%%: before=%s after=%s (min allowed %s)",
+			resubmitDampingFactor*100, before, after, minAllowed)
+	}
+}
+
+func TestRecordGasUsedClampsToBounds(t *testing.T) {
+	m := NewMiningState(nil)
+
+	for i := 0; i < 1000; i++ {
+		m.recordGasUsed(999, 1000)
+	}
+	waitForResubmitAdjust(t, &m)
+
+	if got := m.ResubmitInterval(); got > maxRecommitInterval {
+		t.Fatalf("ResubmitInterval exceeded maxRecommitInterval: got=%s", got)
+	}
+
+	for i := 0; i < 1000; i++ {
+		m.recordGasUsed(1, 1000)
+	}
+	waitForResubmitAdjust(t, &m)
+
+	if got := m.ResubmitInterval(); got < minRecommitInterval {
+		t.Fatalf("ResubmitInterval below minRecommitInterval: got=%s", got)
+	}
+}
+
+func TestRecordGasUsedIgnoresZeroGasLimit(t *testing.T) {
+	m := NewMiningState(nil)
+	before := m.ResubmitInterval()
+
+	m.recordGasUsed(0, 0)
+
+	select {
+	case <-m.ResubmitAdjustCh:
+		t.Fatal("expected no ResubmitAdjust for a zero gasLimit block")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if got := m.ResubmitInterval(); got != before {
+		t.Fatalf("ResubmitInterval changed unexpectedly: before=%s after=%s", before, got)
+	}
+}
+
+func TestComputePayloadIDIsDeterministic(t *testing.T) {
+	attrs := &PayloadAttributes{
+		ParentHash:            common.HexToHash("0x01"),
+		Timestamp:             100,
+		PrevRandao:            common.HexToHash("0x02"),
+		SuggestedFeeRecipient: common.HexToAddress("0x03"),
+	}
+	id1 := computePayloadID(attrs)
+	id2 := computePayloadID(attrs)
+	if id1 != id2 {
+		t.Fatalf("computePayloadID is not deterministic: %x != %x", id1, id2)
+	}
+}
+
+func TestComputePayloadIDDiffersByField(t *testing.T) {
+	base := PayloadAttributes{
+		ParentHash:            common.HexToHash("0x01"),
+		Timestamp:             100,
+		PrevRandao:            common.HexToHash("0x02"),
+		SuggestedFeeRecipient: common.HexToAddress("0x03"),
+	}
+	baseID := computePayloadID(&base)
+
+	withDifferentTimestamp := base
+	withDifferentTimestamp.Timestamp = 101
+	if computePayloadID(&withDifferentTimestamp) == baseID {
+		t.Fatal("computePayloadID did not change with Timestamp")
+	}
+
+	withDifferentParent := base
+	withDifferentParent.ParentHash = common.HexToHash("0x04")
+	if computePayloadID(&withDifferentParent) == baseID {
+		t.Fatal("computePayloadID did not change with ParentHash")
+	}
+}
+
+func TestPublishPayloadResultOverwritesSameID(t *testing.T) {
+	m := NewMiningState(nil)
+	var id PayloadID
+	copy(id[:], []byte("test-payload-id"))
+
+	first := &PayloadResult{ID: id, Block: &MiningBlock{}}
+	m.PublishPayloadResult(first)
+	got, ok := m.PayloadResultByID(id)
+	if !ok || got != first {
+		t.Fatalf("PayloadResultByID after first publish = %v, %v", got, ok)
+	}
+
+	// Publish first again so second has a stale result to overwrite.
+	m.PublishPayloadResult(first)
+	second := &PayloadResult{ID: id, Block: &MiningBlock{}}
+	m.PublishPayloadResult(second)
+	got, ok = m.PayloadResultByID(id)
+	if !ok || got != second {
+		t.Fatalf("PublishPayloadResult did not overwrite the stale result: got=%v", got)
+	}
+}
+
+func TestPayloadResultByIDMissing(t *testing.T) {
+	m := NewMiningState(nil)
+	var id PayloadID
+	if _, ok := m.PayloadResultByID(id); ok {
+		t.Fatal("expected ok=false for an id that was never published")
+	}
+}
+
+func TestPayloadResultByIDEvictsOnRead(t *testing.T) {
+	m := NewMiningState(nil)
+	var id PayloadID
+	copy(id[:], []byte("evict-me"))
+
+	m.PublishPayloadResult(&PayloadResult{ID: id, Block: &MiningBlock{}})
+	if _, ok := m.PayloadResultByID(id); !ok {
+		t.Fatal("expected ok=true for the first poll")
+	}
+	if _, ok := m.PayloadResultByID(id); ok {
+		t.Fatal("expected the result to be evicted after being retrieved once")
+	}
+}
+
+func TestPendingNoSnapshotReturnsNil(t *testing.T) {
+	m := NewMiningState(nil)
+	block, ibs := m.Pending(10)
+	if block != nil || ibs != nil {
+		t.Fatalf("expected (nil, nil) with no snapshot, got (%v, %v)", block, ibs)
+	}
+	if got := m.PendingBlock(10); got != nil {
+		t.Fatalf("expected PendingBlock to be nil with no snapshot, got %v", got)
+	}
+}
+
+func TestPendingWithinThresholdReturnsSnapshot(t *testing.T) {
+	m := NewMiningState(nil)
+	header := &types.Header{Number: big.NewInt(11)}
+	m.setPendingHeader(header, 10)
+
+	block, _ := m.Pending(10)
+	if block == nil || block.Header().Number.Uint64() != 11 {
+		t.Fatalf("expected the pending snapshot built at executionAt=10, got %v", block)
+	}
+	// Still within pendingStaleThreshold blocks behind the new chain head.
+	block, _ = m.Pending(10 + pendingStaleThreshold)
+	if block == nil {
+		t.Fatal("expected the snapshot to still be usable at the staleness boundary")
+	}
+	if got := m.PendingBlock(10); got == nil {
+		t.Fatal("expected PendingBlock to delegate to Pending and return the snapshot")
+	}
+}
+
+func TestPendingBeyondThresholdReturnsNil(t *testing.T) {
+	m := NewMiningState(nil)
+	header := &types.Header{Number: big.NewInt(11)}
+	m.setPendingHeader(header, 10)
+
+	block, ibs := m.Pending(10 + pendingStaleThreshold + 1)
+	if block != nil || ibs != nil {
+		t.Fatalf("expected (nil, nil) once the snapshot is stale, got (%v, %v)", block, ibs)
+	}
+	if got := m.PendingBlock(10 + pendingStaleThreshold + 1); got != nil {
+		t.Fatalf("expected PendingBlock to be nil once stale, got %v", got)
+	}
+}
+
+func TestUpdatePendingResultReplacesSnapshot(t *testing.T) {
+	m := NewMiningState(nil)
+	m.setPendingHeader(&types.Header{Number: big.NewInt(11)}, 10)
+
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(11)})
+	ibs := &state.IntraBlockState{}
+	m.UpdatePendingResult(block, ibs, 10)
+
+	gotBlock, gotIBS := m.Pending(10)
+	if gotBlock != block {
+		t.Fatalf("expected Pending to return the block passed to UpdatePendingResult, got %v", gotBlock)
+	}
+	if gotIBS != ibs {
+		t.Fatalf("expected Pending to return the IntraBlockState passed to UpdatePendingResult, got %v", gotIBS)
+	}
+}
+
+func TestIsPostMergePayloadAttributes(t *testing.T) {
+	if !isPostMerge(&PayloadAttributes{}, nil, nil) {
+		t.Fatal("expected PayloadAttributes-driven blocks to always be post-merge")
+	}
+}
+
+func TestIsPostMergeNoTTD(t *testing.T) {
+	if isPostMerge(nil, nil, big.NewInt(100)) {
+		t.Fatal("expected no TerminalTotalDifficulty configured to mean pre-merge")
+	}
+}
+
+func TestIsPostMergeBelowTTD(t *testing.T) {
+	ttd := big.NewInt(100)
+	if isPostMerge(nil, ttd, big.NewInt(99)) {
+		t.Fatal("expected a parent below TerminalTotalDifficulty to mean pre-merge")
+	}
+}
+
+func TestIsPostMergeAtOrAboveTTD(t *testing.T) {
+	ttd := big.NewInt(100)
+	if !isPostMerge(nil, ttd, big.NewInt(100)) {
+		t.Fatal("expected a parent at TerminalTotalDifficulty to mean post-merge")
+	}
+	if !isPostMerge(nil, ttd, big.NewInt(101)) {
+		t.Fatal("expected a parent above TerminalTotalDifficulty to mean post-merge")
+	}
+}
+
+func TestIsPostMergeNilParentTd(t *testing.T) {
+	if isPostMerge(nil, big.NewInt(100), nil) {
+		t.Fatal("expected an unknown parent total difficulty to mean pre-merge")
+	}
+}
+
+// waitForResubmitAdjust gives the resubmitState.consume goroutine a chance to
+// drain ResubmitAdjustCh before the test reads ResubmitInterval.
+func waitForResubmitAdjust(t *testing.T, m *MiningState) {
+	t.Helper()
+	deadline := time.After(time.Second)
+	for {
+		m.resubmit.mu.Lock()
+		empty := len(m.ResubmitAdjustCh) == 0
+		m.resubmit.mu.Unlock()
+		if empty {
+			return
+		}
+		select {
+		case <-deadline:
+			t.Fatal("timed out waiting for ResubmitAdjustCh to drain")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package stagedsync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ledgerwatch/erigon-lib/kv"
+	"github.com/ledgerwatch/erigon-lib/txpool"
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/core"
+	"github.com/ledgerwatch/erigon/core/types"
+)
+
+// TxOrderer selects and orders the transactions handed to block assembly.
+// It lets operators plug in a custom ordering or bundle-merging strategy
+// (e.g. a builder/searcher integration) without hard-coding any particular
+// MEV product into SpawnMiningCreateBlockStage.
+type TxOrderer interface {
+	// Order returns the stream of transactions to include in header, on top
+	// of parent. pending, if non-empty, are forced-inclusion transactions
+	// (e.g. from PayloadAttributes) that implementations should place ahead
+	// of anything they source themselves.
+	Order(ctx context.Context, parent, header *types.Header, pending []types.Transaction, signer *types.Signer) (types.TransactionsStream, error)
+}
+
+// defaultTxOrderer reproduces the stage's original transaction selection:
+// txpool v2's fixed order (it doesn't prioritise local transactions) if
+// present, otherwise txpool v1's locals-first price-and-nonce grouping.
+type defaultTxOrderer struct {
+	txPool    *core.TxPool
+	txPool2   *txpool.TxPool
+	txPool2DB kv.RoDB
+}
+
+// NewDefaultTxOrderer builds the TxOrderer used by StageMiningCreateBlockCfg
+// unless overridden via WithTxOrderer.
+func NewDefaultTxOrderer(txPool *core.TxPool, txPool2 *txpool.TxPool, txPool2DB kv.RoDB) TxOrderer {
+	return &defaultTxOrderer{txPool: txPool, txPool2: txPool2, txPool2DB: txPool2DB}
+}
+
+func (o *defaultTxOrderer) Order(ctx context.Context, parent, header *types.Header, pending []types.Transaction, signer *types.Signer) (types.TransactionsStream, error) {
+	var stream types.TransactionsStream
+	if o.txPool2 != nil {
+		txSlots := txpool.TxsRlp{}
+		if err := o.txPool2DB.View(ctx, func(tx kv.Tx) error {
+			if err := o.txPool2.Best(200, &txSlots, tx); err != nil {
+				return err
+			}
+			for i := 0; i < len(txSlots.Txs); i++ {
+				txSlots.Txs[i] = common.CopyBytes(txSlots.Txs[i]) // because we need this data outside of tx
+			}
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		txs, err := types.UnmarshalTransactionsFromBinary(txSlots.Txs)
+		if err != nil {
+			return nil, fmt.Errorf("decode rlp of pending txs: %w", err)
+		}
+		var sender common.Address
+		for i := range txs {
+			copy(sender[:], txSlots.Senders.At(i))
+			txs[i].SetSender(sender)
+		}
+		// txpool v2 - doesn't prioritise local txs over remote
+		stream = types.NewTransactionsFixedOrder(txs)
+	} else {
+		pendingTxs, err := o.txPool.Pending()
+		if err != nil {
+			return nil, err
+		}
+		txPoolLocals := o.txPool.Locals()
+		// Split the pending transactions into locals and remotes
+		localTxs, remoteTxs := types.TransactionsGroupedBySender{}, types.TransactionsGroupedBySender{}
+		for _, txs := range pendingTxs {
+			if len(txs) == 0 {
+				continue
+			}
+			from, _ := txs[0].Sender(*signer)
+			isLocal := false
+			for _, local := range txPoolLocals {
+				if local == from {
+					isLocal = true
+					break
+				}
+			}
+
+			if isLocal {
+				localTxs = append(localTxs, txs)
+			} else {
+				remoteTxs = append(remoteTxs, txs)
+			}
+		}
+
+		stream = newLocalsFirstStream(
+			types.NewTransactionsByPriceAndNonce(*signer, localTxs),
+			types.NewTransactionsByPriceAndNonce(*signer, remoteTxs),
+		)
+	}
+
+	if len(pending) == 0 {
+		return stream, nil
+	}
+	// Forced-inclusion transactions always go first, ahead of anything pulled from the mempool.
+	return newLocalsFirstStream(types.NewTransactionsFixedOrder(pending), stream), nil
+}
+
+// localsFirstStream drains first fully before moving on to second; it
+// adapts two TransactionsStream into one without losing either's ordering.
+type localsFirstStream struct {
+	first  types.TransactionsStream
+	second types.TransactionsStream
+}
+
+func newLocalsFirstStream(first, second types.TransactionsStream) types.TransactionsStream {
+	return &localsFirstStream{first: first, second: second}
+}
+
+func (s *localsFirstStream) Peek() types.Transaction {
+	if tx := s.first.Peek(); tx != nil {
+		return tx
+	}
+	return s.second.Peek()
+}
+
+func (s *localsFirstStream) Shift() {
+	if s.first.Peek() != nil {
+		s.first.Shift()
+		return
+	}
+	s.second.Shift()
+}
+
+func (s *localsFirstStream) Pop() {
+	if s.first.Peek() != nil {
+		s.first.Pop()
+		return
+	}
+	s.second.Pop()
+}
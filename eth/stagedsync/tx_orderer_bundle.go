@@ -0,0 +1,202 @@
+package stagedsync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/ledgerwatch/erigon/common"
+	"github.com/ledgerwatch/erigon/common/hexutil"
+	"github.com/ledgerwatch/erigon/core/types"
+	"github.com/ledgerwatch/log/v3"
+)
+
+// Bundle is an opaque, atomically-included set of transactions submitted by
+// an out-of-process builder/searcher. All of a bundle's transactions must
+// land (or revert) together, except for the whitelisted RevertingTxHashes,
+// which are allowed to revert without failing the whole bundle.
+//
+// BundleOrderer does not itself enforce this guarantee, and can't: deciding
+// whether a bundle reverted requires executing it, which only an exec stage
+// can tell, and this tree has none. Treat bundle submission as merge-only
+// (ordering/inclusion) until an exec stage lands and is wired up to honor
+// RevertWhitelist; see Order. Order logs a warning whenever it
+// merges a bundle that declares RevertingTxHashes, since that's the only
+// honest signal this tree can give an operator that the guarantee isn't
+// actually held.
+type Bundle struct {
+	ParentHash        common.Hash     `json:"parentHash"`
+	BlockNumber       uint64          `json:"blockNumber"`
+	Txs               []hexutil.Bytes `json:"txs"`
+	MinTimestamp      uint64          `json:"minTimestamp"`
+	MaxTimestamp      uint64          `json:"maxTimestamp"`
+	RevertingTxHashes []common.Hash   `json:"revertingTxHashes"`
+}
+
+// bundleDecision is the outcome of matching a Bundle against the block
+// currently being assembled.
+type bundleDecision int
+
+const (
+	bundleDrop    bundleDecision = iota // stale: won't ever apply to this chain again
+	bundlePending                       // not yet eligible: keep for a later round
+	bundleReady                         // eligible: merge into this block
+)
+
+// decideBundle matches a Bundle's targeting fields against the block being
+// assembled.
+func decideBundle(b *Bundle, parentHash common.Hash, blockNum uint64, headerTime uint64) bundleDecision {
+	if b.ParentHash != parentHash {
+		return bundleDrop // the chain moved past this bundle's parent
+	}
+	if b.BlockNumber != 0 && b.BlockNumber != blockNum {
+		return bundleDrop // targets a different block height
+	}
+	if b.MaxTimestamp != 0 && headerTime > b.MaxTimestamp {
+		return bundleDrop // acceptance window has closed
+	}
+	if headerTime < b.MinTimestamp {
+		return bundlePending
+	}
+	return bundleReady
+}
+
+// BundleOrderer is a TxOrderer that accepts Bundle submissions from an
+// out-of-process builder/searcher over a Unix socket (one JSON object per
+// line) and merges them ahead of the transactions produced by fallback.
+// Bundles whose ParentHash no longer matches the block being assembled are
+// dropped. This gives operators a builder/searcher integration point
+// without hard-coding any specific MEV product into the stage.
+type BundleOrderer struct {
+	fallback TxOrderer
+
+	mu              sync.Mutex
+	bundles         []*Bundle
+	revertWhitelist map[common.Hash]struct{}
+}
+
+// NewBundleOrderer listens on socketPath for bundle submissions and returns
+// a TxOrderer that merges them ahead of fallback's output. The listener is
+// closed when ctx is done.
+//
+// Per-bundle atomicity (all-or-nothing revert, modulo RevertingTxHashes) is
+// not enforced by the returned orderer in this tree: that requires an exec
+// stage to tell bundled transactions apart from the rest once executed, and
+// none exists here yet. Operators relying on atomic bundle inclusion should
+// not treat this as a complete builder integration until that lands.
+func NewBundleOrderer(ctx context.Context, socketPath string, fallback TxOrderer) (*BundleOrderer, error) {
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("listening on bundle socket %s: %w", socketPath, err)
+	}
+	bo := &BundleOrderer{fallback: fallback}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	go bo.acceptLoop(l)
+	return bo, nil
+}
+
+func (bo *BundleOrderer) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Debug("bundle orderer: listener closed", "err", err)
+			return
+		}
+		go bo.readBundles(conn)
+	}
+}
+
+func (bo *BundleOrderer) readBundles(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(bufio.NewReader(conn))
+	for {
+		var b Bundle
+		if err := dec.Decode(&b); err != nil {
+			return
+		}
+		bo.mu.Lock()
+		bo.bundles = append(bo.bundles, &b)
+		bo.mu.Unlock()
+	}
+}
+
+// Order implements TxOrderer. Bundles targeting parent/header are decoded
+// and merged, in submission order, after pending and ahead of fallback's
+// stream; a bundle that fails to decode is dropped.
+// A bundle is pruned once its parent has moved on, it targets a different
+// block number, or header.Time has passed its MaxTimestamp; a bundle whose
+// MinTimestamp hasn't arrived yet is kept for a later round instead.
+//
+// RevertingTxHashes is not enforced here: doing so requires knowing which
+// transactions actually reverted, which only the exec stage can tell - and
+// this tree has no exec stage. Order instead exposes the whitelist via
+// RevertWhitelist so a future exec stage can enforce per-bundle atomicity
+// once it exists, rather than silently dropping the guarantee the field implies.
+func (bo *BundleOrderer) Order(ctx context.Context, parent, header *types.Header, pending []types.Transaction, signer *types.Signer) (types.TransactionsStream, error) {
+	parentHash := parent.Hash()
+	blockNum := header.Number.Uint64()
+
+	bo.mu.Lock()
+	live := make([]*Bundle, 0, len(bo.bundles))
+	whitelist := make(map[common.Hash]struct{})
+	var bundled []types.Transaction
+	for _, b := range bo.bundles {
+		switch decideBundle(b, parentHash, blockNum, header.Time) {
+		case bundleDrop:
+			continue
+		case bundlePending:
+			live = append(live, b) // not yet eligible, retry next round
+			continue
+		}
+		rawTxs := make([][]byte, len(b.Txs))
+		for i, raw := range b.Txs {
+			rawTxs[i] = raw
+		}
+		txs, err := types.UnmarshalTransactionsFromBinary(rawTxs)
+		if err != nil {
+			log.Warn("bundle orderer: dropping undecodable bundle", "err", err)
+			continue
+		}
+		live = append(live, b)
+		bundled = append(bundled, txs...)
+		if len(b.RevertingTxHashes) > 0 {
+			log.Warn("bundle orderer: merging a bundle with a revert whitelist that isn't enforced in this tree",
+				"parentHash", parentHash, "blockNumber", blockNum, "revertingTxHashes", len(b.RevertingTxHashes))
+		}
+		for _, h := range b.RevertingTxHashes {
+			whitelist[h] = struct{}{}
+		}
+	}
+	bo.bundles = live
+	bo.revertWhitelist = whitelist
+	bo.mu.Unlock()
+
+	rest, err := bo.fallback.Order(ctx, parent, header, nil, signer)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := rest
+	if len(bundled) > 0 {
+		stream = newLocalsFirstStream(types.NewTransactionsFixedOrder(bundled), stream)
+	}
+	if len(pending) > 0 {
+		stream = newLocalsFirstStream(types.NewTransactionsFixedOrder(pending), stream)
+	}
+	return stream, nil
+}
+
+// RevertWhitelist returns the RevertingTxHashes of every bundle merged by
+// the most recent Order call. It is not enforced by BundleOrderer itself;
+// see Order.
+func (bo *BundleOrderer) RevertWhitelist() map[common.Hash]struct{} {
+	bo.mu.Lock()
+	defer bo.mu.Unlock()
+	return bo.revertWhitelist
+}
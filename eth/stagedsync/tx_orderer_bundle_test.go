@@ -0,0 +1,65 @@
+package stagedsync
+
+import (
+	"testing"
+
+	"github.com/ledgerwatch/erigon/common"
+)
+
+func TestDecideBundle(t *testing.T) {
+	parentHash := common.HexToHash("0x01")
+	otherHash := common.HexToHash("0x02")
+
+	cases := []struct {
+		name string
+		b    *Bundle
+		want bundleDecision
+	}{
+		{
+			name: "parent mismatch is dropped",
+			b:    &Bundle{ParentHash: otherHash},
+			want: bundleDrop,
+		},
+		{
+			name: "block number mismatch is dropped",
+			b:    &Bundle{ParentHash: parentHash, BlockNumber: 99},
+			want: bundleDrop,
+		},
+		{
+			name: "zero block number matches any height",
+			b:    &Bundle{ParentHash: parentHash, BlockNumber: 0},
+			want: bundleReady,
+		},
+		{
+			name: "expired max timestamp is dropped",
+			b:    &Bundle{ParentHash: parentHash, MaxTimestamp: 99},
+			want: bundleDrop,
+		},
+		{
+			name: "zero max timestamp never expires",
+			b:    &Bundle{ParentHash: parentHash, MaxTimestamp: 0},
+			want: bundleReady,
+		},
+		{
+			name: "min timestamp not yet reached is pending",
+			b:    &Bundle{ParentHash: parentHash, MinTimestamp: 200},
+			want: bundlePending,
+		},
+		{
+			name: "fully matching bundle is ready",
+			b:    &Bundle{ParentHash: parentHash, BlockNumber: 100, MinTimestamp: 50, MaxTimestamp: 150},
+			want: bundleReady,
+		},
+	}
+
+	const blockNum = 100
+	const headerTime = 100
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := decideBundle(c.b, parentHash, blockNum, headerTime); got != c.want {
+				t.Fatalf("decideBundle() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}